@@ -0,0 +1,281 @@
+// Copyright 2015 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by MIT license,
+// a copy can be found in the LICENSE file.
+
+package sse
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRetry is the reconnection delay a Client falls back to until the
+// server sends a retry: field of its own.
+const DefaultRetry = 3 * time.Second
+
+// ErrClosed is returned by Next and Decode when Close cancels a blocked
+// read or a pending reconnect backoff, instead of either one surfacing
+// the underlying transport error or looping forever.
+var ErrClosed = errors.New("sse: client closed")
+
+// Client consumes a remote SSE endpoint, decoding its byte stream into
+// structured Events. It mirrors Streamer on the consumer side, so tests
+// and tools can exercise a Streamer without a browser.
+//
+// A Client is not safe for concurrent use, except that Close may be
+// called from another goroutine to cancel a Next call blocked in it.
+type Client struct {
+	// URL is the endpoint to GET and parse as text/event-stream.
+	URL string
+
+	// HTTPClient is used to perform the request. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	lastEventID string
+	retry       time.Duration
+
+	// mu guards resp, reader and closing, which Close may touch from
+	// another goroutine while Next is using them; the blocking Read
+	// itself happens outside mu, so Close is never kept waiting on it.
+	mu      sync.Mutex
+	resp    *http.Response
+	reader  *bufio.Reader
+	closing chan struct{} // closed by Close to cancel a blocked read or a pending reconnect backoff
+}
+
+// NewClient returns a new Client for the given SSE endpoint URL.
+func NewClient(url string) *Client {
+	return &Client{
+		URL:        url,
+		HTTPClient: http.DefaultClient,
+		retry:      DefaultRetry,
+		closing:    make(chan struct{}),
+	}
+}
+
+// Close terminates the underlying connection, if any. The Client may be
+// reused afterwards; Next will reconnect on its next call. Close is safe
+// to call from another goroutine to cancel a Next call that is blocked
+// reading or waiting to reconnect; the cancelled Next returns ErrClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	select {
+	case <-c.closing:
+		// already signalled since the last beginAttempt
+	default:
+		close(c.closing)
+	}
+	c.mu.Unlock()
+	return c.closeConn()
+}
+
+func (c *Client) closeConn() error {
+	c.mu.Lock()
+	resp := c.resp
+	c.resp = nil
+	c.reader = nil
+	c.mu.Unlock()
+
+	if resp == nil {
+		return nil
+	}
+	return resp.Body.Close()
+}
+
+// getReader returns the current bufio.Reader, or nil if not connected.
+func (c *Client) getReader() *bufio.Reader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reader
+}
+
+// beginAttempt clears any earlier Close signal before a fresh
+// connect/read attempt, so a stale cancellation doesn't carry forward
+// into an attempt Close was never meant to cancel.
+func (c *Client) beginAttempt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closing:
+		c.closing = make(chan struct{})
+	default:
+	}
+}
+
+// isClosing reports whether Close has been called since beginAttempt.
+func (c *Client) isClosing() bool {
+	c.mu.Lock()
+	closing := c.closing
+	c.mu.Unlock()
+	select {
+	case <-closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitRetry waits out the reconnect delay, or returns false early if
+// Close is called in the meantime.
+func (c *Client) waitRetry() bool {
+	c.mu.Lock()
+	closing := c.closing
+	c.mu.Unlock()
+	select {
+	case <-time.After(c.retry):
+		return true
+	case <-closing:
+		return false
+	}
+}
+
+func (c *Client) connect() error {
+	req, err := http.NewRequest(http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", c.lastEventID)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("sse: unexpected status %s", resp.Status)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	c.mu.Lock()
+	c.resp = resp
+	c.reader = reader
+	c.mu.Unlock()
+	return nil
+}
+
+// Next blocks until the next Event arrives and returns it. On any
+// transport error - failing to (re)connect or a broken read - it retries
+// automatically, waiting the last retry delay seen from the server (or
+// DefaultRetry) and resending Last-Event-ID so the server can replay
+// anything missed. Close cancels a call blocked in Next, which then
+// returns ErrClosed.
+func (c *Client) Next() (*Event, error) {
+	for {
+		c.beginAttempt()
+
+		reader := c.getReader()
+		if reader == nil {
+			if err := c.connect(); err != nil {
+				if !c.waitRetry() {
+					return nil, ErrClosed
+				}
+				continue
+			}
+			reader = c.getReader()
+		}
+
+		ev, err := c.readEvent(reader)
+		if err != nil {
+			c.closeConn()
+			if c.isClosing() {
+				// Close was called to deliberately cancel this read;
+				// report it instead of masking it as a reconnect.
+				return nil, ErrClosed
+			}
+			// Any other error reading the stream - EOF, a reset
+			// connection, a read timeout, whatever the transport wraps
+			// it as - means the connection is gone, so reconnect and
+			// resume from lastEventID rather than surfacing a hard
+			// error.
+			if !c.waitRetry() {
+				return nil, ErrClosed
+			}
+			continue
+		}
+
+		if ev.ID != "" {
+			c.lastEventID = ev.ID
+		}
+		if ev.Retry > 0 {
+			c.retry = time.Duration(ev.Retry) * time.Millisecond
+		}
+		return ev, nil
+	}
+}
+
+// Decode calls Next and JSON-unmarshals its Data into dst.
+func (c *Client) Decode(dst interface{}) error {
+	ev, err := c.Next()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(ev.Data, dst)
+}
+
+// readEvent implements the EventSource stream-parsing algorithm: lines
+// are accumulated until a blank line triggers dispatch, ":"-prefixed
+// lines are comments and ignored, and repeated data: lines are joined
+// with "\n". reader is read outside of c.mu, so a concurrent Close can
+// close the underlying connection without waiting for it to unblock.
+func (c *Client) readEvent(reader *bufio.Reader) (*Event, error) {
+	var (
+		id, event string
+		data      strings.Builder
+		hasData   bool
+		retry     int
+	)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if !hasData && id == "" && event == "" && retry == 0 {
+				continue // nothing accumulated yet, nothing to dispatch
+			}
+			d := []byte(data.String())
+			if len(d) > 0 {
+				d = d[:len(d)-1] // drop the trailing \n added after the last data: line
+			}
+			return &Event{ID: id, Event: event, Data: d, Retry: retry}, nil
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue // comment
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			id = value
+		case "retry":
+			if n, err := strconv.Atoi(value); err == nil {
+				retry = n
+			}
+		}
+	}
+}
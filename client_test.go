@@ -0,0 +1,226 @@
+// Copyright 2015 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by MIT license,
+// a copy can be found in the LICENSE file.
+
+package sse
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientNextParsesMultiLineDataRetryAndComments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ":this is a comment\n")
+		fmt.Fprint(w, "id:1\nretry:50\nevent:greeting\ndata:line one\ndata:line two\n\n")
+		w.(http.Flusher).Flush()
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL)
+	defer c.Close()
+
+	ev, err := c.Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if ev.ID != "1" || ev.Event != "greeting" || string(ev.Data) != "line one\nline two" {
+		t.Fatalf("Next() = %+v, want id=1 event=greeting data=%q", ev, "line one\nline two")
+	}
+	if ev.Retry != 50 {
+		t.Errorf("Retry = %d, want 50", ev.Retry)
+	}
+	if c.retry != 50*time.Millisecond {
+		t.Errorf("c.retry after a retry: field = %v, want 50ms", c.retry)
+	}
+	if c.lastEventID != "1" {
+		t.Errorf("lastEventID = %q, want %q", c.lastEventID, "1")
+	}
+}
+
+func TestClientCloseUnblocksNextInsteadOfReconnecting(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // block until the client disconnects
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL)
+	c.retry = time.Millisecond
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.Next()
+		result <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond) // let Next() block inside readEvent
+	c.Close()
+
+	select {
+	case err := <-result:
+		if err != ErrClosed {
+			t.Fatalf("Next() returned %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next() did not return after Close; it kept reconnecting")
+	}
+}
+
+func TestClientNextRetriesConnectFailureBeforeGivingUp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close() // nothing listening yet: the first connect attempts must refuse
+
+	c := NewClient("http://" + addr)
+	c.retry = 10 * time.Millisecond
+	defer c.Close()
+
+	result := make(chan *Event, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		ev, err := c.Next()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		result <- ev
+	}()
+
+	time.Sleep(50 * time.Millisecond) // let a few dial failures retry
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "id:1\ndata:finally\n\n")
+		w.(http.Flusher).Flush()
+	})}
+	ln2, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("re-listen on %s: %v", addr, err)
+	}
+	go srv.Serve(ln2)
+	defer srv.Close()
+
+	select {
+	case ev := <-result:
+		if string(ev.Data) != "finally" {
+			t.Errorf("got data %q, want %q", ev.Data, "finally")
+		}
+	case err := <-errCh:
+		t.Fatalf("Next() gave up instead of retrying the dial failure: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Next() never recovered after the server came up")
+	}
+}
+
+func TestClientCloseDuringReconnectBackoffCancelsNext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Error("ResponseWriter is not a Hijacker")
+			return
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Errorf("Hijack() error = %v", err)
+			return
+		}
+		conn.Close() // drop the connection before any response is written
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL)
+	c.retry = time.Second // long enough that Close lands during the backoff sleep
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.Next()
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond) // let the failed connect enter the backoff sleep
+	c.Close()
+
+	select {
+	case err := <-result:
+		if err != ErrClosed {
+			t.Fatalf("Next() returned %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next() did not return after Close during reconnect backoff")
+	}
+}
+
+func TestClientNextReconnectsAfterTransportErrorAndResendsLastEventID(t *testing.T) {
+	var reqs int32
+	var mu sync.Mutex
+	var gotLastEventID string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&reqs, 1) == 1 {
+			// Serve one full event, then reset the connection instead of
+			// closing it gracefully, simulating a dropped connection
+			// rather than a clean EOF.
+			hj := w.(http.Hijacker)
+			conn, bufrw, err := hj.Hijack()
+			if err != nil {
+				t.Errorf("Hijack() error = %v", err)
+				return
+			}
+			defer conn.Close()
+			fmt.Fprint(bufrw, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\n")
+			fmt.Fprint(bufrw, "id:1\ndata:first\n\n")
+			bufrw.Flush()
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetLinger(0) // force RST instead of FIN
+			}
+			return
+		}
+
+		mu.Lock()
+		gotLastEventID = r.Header.Get("Last-Event-ID")
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "id:2\ndata:second\n\n")
+		w.(http.Flusher).Flush()
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL)
+	c.retry = time.Millisecond // reconnect quickly
+	defer c.Close()
+
+	ev, err := c.Next()
+	if err != nil {
+		t.Fatalf("first Next() error = %v", err)
+	}
+	if string(ev.Data) != "first" {
+		t.Fatalf("first Next() data = %q, want %q", ev.Data, "first")
+	}
+
+	ev, err = c.Next() // the reset connection surfaces here and must reconnect
+	if err != nil {
+		t.Fatalf("second Next() error = %v", err)
+	}
+	if string(ev.Data) != "second" {
+		t.Fatalf("second Next() data = %q, want %q", ev.Data, "second")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if gotLastEventID != "1" {
+		t.Errorf("reconnect Last-Event-ID = %q, want %q", gotLastEventID, "1")
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2015 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by MIT license,
+// a copy can be found in the LICENSE file.
+
+package sse
+
+// Event is a single Server-Sent Event as parsed from a stream by Client.
+// It mirrors the fields a Streamer can emit: Event and ID are left empty
+// when the corresponding field was absent from the wire, and Data holds
+// the concatenation of all data: lines, joined with "\n".
+type Event struct {
+	ID    string
+	Event string
+	Data  []byte
+
+	// Retry is the reconnection delay in milliseconds requested by the
+	// server via a retry: field, or 0 if none was sent with this event.
+	Retry int
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by MIT license,
+// a copy can be found in the LICENSE file.
+
+package sse
+
+import (
+	"strconv"
+	"sync"
+)
+
+// replayEntry is one serialized event retained by a replayBuffer.
+type replayEntry struct {
+	id    string
+	topic string
+	data  []byte
+}
+
+// replayBuffer is a bounded ring buffer of serialized events, keyed by
+// their SSE id, used to replay events a reconnecting client missed. It is
+// safe for concurrent use: push runs on the Streamer's broadcaster
+// goroutine, since is called from serving goroutines and nextID from
+// whichever goroutines call the Send* methods.
+type replayBuffer struct {
+	mu      sync.Mutex
+	entries []replayEntry
+	start   int
+	size    int
+	counter uint64
+}
+
+func newReplayBuffer(capacity int) *replayBuffer {
+	return &replayBuffer{entries: make([]replayEntry, capacity)}
+}
+
+// nextID returns a monotonically increasing id for callers that want
+// replay but don't supply ids of their own.
+func (b *replayBuffer) nextID() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.counter++
+	return strconv.FormatUint(b.counter, 10)
+}
+
+// push appends a serialized event for topic, evicting the oldest entry
+// once the buffer is full.
+func (b *replayBuffer) push(id, topic string, data []byte) {
+	if len(b.entries) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	idx := (b.start + b.size) % len(b.entries)
+	if b.size == len(b.entries) {
+		b.start = (b.start + 1) % len(b.entries)
+	} else {
+		b.size++
+	}
+	b.entries[idx] = replayEntry{id: id, topic: topic, data: data}
+}
+
+// since returns the serialized events after the one identified by
+// lastID whose topic is in topics, in order. If lastID is unknown or
+// stale (no longer in the buffer), every matching-topic entry in the
+// buffer is returned as a best-effort replay. topics should include
+// every topic the reconnecting client is subscribed to, so an entry
+// never reaches a client that was never subscribed to its topic.
+func (b *replayBuffer) since(lastID string, topics map[string]struct{}) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.size == 0 {
+		return nil
+	}
+
+	from := 0
+	for i := 0; i < b.size; i++ {
+		if b.entries[(b.start+i)%len(b.entries)].id == lastID {
+			from = i + 1
+			break
+		}
+	}
+
+	out := make([][]byte, 0, b.size-from)
+	for i := from; i < b.size; i++ {
+		e := b.entries[(b.start+i)%len(b.entries)]
+		if _, ok := topics[e.topic]; ok {
+			out = append(out, e.data)
+		}
+	}
+	return out
+}
@@ -11,148 +11,467 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type client chan []byte
 
-// Streamer receives events and broadcasts them to all connected clients.
+// lagEvent is the synthetic notice sent to a client right before it's
+// disconnected for falling behind under LagPolicyDisconnect.
+var lagEvent = format("", "lag", 0, nil)
+
+// LagPolicy controls what a Streamer does when a client's buffered queue
+// is full and a new event needs to be delivered to it.
+type LagPolicy int
+
+const (
+	// LagPolicyDropOldest drops the oldest queued event to make room for
+	// the new one, keeping the connection open. Every drop, under either
+	// policy, increments the Streamer-wide Stats Dropped counter.
+	LagPolicyDropOldest LagPolicy = iota
+
+	// LagPolicyDisconnect drops the new event while the queue is full;
+	// on the MaxConsecutiveDrops-th consecutive drop it sends a synthetic
+	// "event: lag" notice and disconnects the client so it reconnects (and, with replay enabled, catches up
+	// via Last-Event-ID).
+	LagPolicyDisconnect
+)
+
+const (
+	// DefaultClientQueue is the default size of a client's buffered
+	// event queue.
+	DefaultClientQueue = 32
+
+	// DefaultMaxConsecutiveDrops is the default number of consecutive
+	// drops under LagPolicyDisconnect at which a client is disconnected.
+	DefaultMaxConsecutiveDrops = 8
+)
+
+// StreamerOptions configures a Streamer returned by NewWithOptions. The
+// zero value of every field falls back to its documented default.
+type StreamerOptions struct {
+	// ClientQueue is the size of each client's buffered event queue.
+	ClientQueue int
+
+	// LagPolicy controls what happens when a client's queue is full.
+	LagPolicy LagPolicy
+
+	// MaxConsecutiveDrops is the number of consecutive drops under
+	// LagPolicyDisconnect at which the client is disconnected.
+	MaxConsecutiveDrops int
+
+	// ReplayCapacity, if non-zero, enables Last-Event-ID replay with a
+	// ring buffer retaining this many serialized events.
+	ReplayCapacity int
+
+	// OnDisconnect, if set, is called whenever a client is disconnected,
+	// with a short human-readable reason ("closed" or "lag").
+	OnDisconnect func(reason string)
+}
+
+// Stats holds a snapshot of a Streamer's broadcast counters.
+type Stats struct {
+	Connected int    // currently connected clients
+	Dropped   uint64 // events dropped across all clients
+	Lagged    uint64 // clients disconnected for falling behind
+}
+
+// defaultTopic is the implicit topic every client is subscribed to on top
+// of whatever topics it requested, so untargeted Send* calls keep reaching
+// every connected client regardless of topic subscriptions.
+const defaultTopic = ""
+
+// event is a serialized event together with the id and topic it was sent
+// under, so the broadcaster can feed it into the replay buffer and route
+// it to the right subscribers.
+type event struct {
+	id    string
+	topic string
+	data  []byte
+}
+
+// subscriber is a connecting client together with the topics it wants to
+// receive events for, in addition to the default broadcast topic.
+type subscriber struct {
+	cl     client
+	topics []string
+}
+
+// TopicsFunc, if set, is called for every incoming connection to derive
+// the topics it should subscribe to, taking precedence over the `topic`
+// query parameter(s).
+type TopicsFunc func(*http.Request) []string
+
+// clientInfo is the broadcaster's bookkeeping for one connected client:
+// the topics it subscribes to and its lag-handling state. It is only
+// ever touched by the run goroutine.
+type clientInfo struct {
+	topics           map[string]struct{}
+	consecutiveDrops int
+}
+
+// Streamer receives events and broadcasts them to connected clients,
+// either to everyone or, when a topic is given, to the subset of clients
+// subscribed to it.
 type Streamer struct {
-	event         chan []byte
-	clients       map[client]bool
-	connecting    chan client
+	// TopicsFunc derives the topics a connecting client subscribes to
+	// from its request. If nil, topics are read from the `topic` query
+	// parameter(s) instead.
+	TopicsFunc TopicsFunc
+
+	// PushResources are paths pre-pushed via HTTP/2 Server Push, if the
+	// ResponseWriter implements http.Pusher, before the first event is
+	// written.
+	PushResources []string
+
+	event         chan event
+	clients       map[client]*clientInfo
+	byTopic       map[string]map[client]struct{} // topic -> subscribed clients
+	connecting    chan subscriber
 	disconnecting chan client
+
+	clientQueue         int
+	lagPolicy           LagPolicy
+	maxConsecutiveDrops int
+	onDisconnect        func(reason string)
+
+	replay *replayBuffer
+
+	retryMillis    atomic.Int64 // current retry: value advertised to new connections, 0 if unset
+	retryPending   atomic.Bool  // whether the next broadcast should also carry retry:
+	heartbeatNanos atomic.Int64 // keepalive comment interval, 0 disables it
+
+	connected atomic.Int64
+	dropped   atomic.Uint64
+	lagged    atomic.Uint64
 }
 
-// New returns a new initialized SSE Streamer
+// New returns a new initialized SSE Streamer using default options.
 func New() *Streamer {
+	return NewWithOptions(StreamerOptions{})
+}
+
+// NewWithReplay returns a new Streamer that retains the last capacity
+// serialized events in a ring buffer keyed by id. Clients that reconnect
+// with a Last-Event-ID still held in the buffer are caught up on
+// whatever they missed before being registered for new events.
+func NewWithReplay(capacity int) *Streamer {
+	return NewWithOptions(StreamerOptions{ReplayCapacity: capacity})
+}
+
+// NewWithOptions returns a new Streamer configured by opts. Zero-valued
+// fields in opts fall back to their documented defaults.
+func NewWithOptions(opts StreamerOptions) *Streamer {
+	clientQueue := opts.ClientQueue
+	if clientQueue <= 0 {
+		clientQueue = DefaultClientQueue
+	}
+	maxConsecutiveDrops := opts.MaxConsecutiveDrops
+	if maxConsecutiveDrops <= 0 {
+		maxConsecutiveDrops = DefaultMaxConsecutiveDrops
+	}
+
 	s := &Streamer{
-		event:         make(chan []byte, 1),
-		clients:       make(map[client]bool),
-		connecting:    make(chan client),
-		disconnecting: make(chan client),
+		event:               make(chan event, 1),
+		clients:             make(map[client]*clientInfo),
+		byTopic:             make(map[string]map[client]struct{}),
+		connecting:          make(chan subscriber),
+		disconnecting:       make(chan client),
+		clientQueue:         clientQueue,
+		lagPolicy:           opts.LagPolicy,
+		maxConsecutiveDrops: maxConsecutiveDrops,
+		onDisconnect:        opts.OnDisconnect,
+	}
+	if opts.ReplayCapacity > 0 {
+		s.replay = newReplayBuffer(opts.ReplayCapacity)
 	}
 
 	s.run()
 	return s
 }
 
+// Stats returns a snapshot of the Streamer's broadcast counters.
+func (s *Streamer) Stats() Stats {
+	return Stats{
+		Connected: int(s.connected.Load()),
+		Dropped:   s.dropped.Load(),
+		Lagged:    s.lagged.Load(),
+	}
+}
+
 // run starts a goroutine to handle client connects and broadcast events.
 func (s *Streamer) run() {
 	go func() {
 		for {
 			select {
-			case cl := <-s.connecting:
-				s.clients[cl] = true
+			case sub := <-s.connecting:
+				topics := make(map[string]struct{}, len(sub.topics)+1)
+				topics[defaultTopic] = struct{}{}
+				for _, t := range sub.topics {
+					topics[t] = struct{}{}
+				}
+				s.clients[sub.cl] = &clientInfo{topics: topics}
+				for t := range topics {
+					if s.byTopic[t] == nil {
+						s.byTopic[t] = make(map[client]struct{})
+					}
+					s.byTopic[t][sub.cl] = struct{}{}
+				}
+				s.connected.Add(1)
 
 			case cl := <-s.disconnecting:
-				delete(s.clients, cl)
+				s.removeClient(cl, "closed")
 
-			case event := <-s.event:
-				for cl := range s.clients {
-					cl <- event
+			case ev := <-s.event:
+				if s.replay != nil {
+					s.replay.push(ev.id, ev.topic, ev.data)
+				}
+				if ev.topic == defaultTopic {
+					for cl, info := range s.clients {
+						s.deliver(cl, info, ev.data)
+					}
+					continue
+				}
+				for cl := range s.byTopic[ev.topic] {
+					s.deliver(cl, s.clients[cl], ev.data)
 				}
 			}
 		}
 	}()
 }
 
-func format(id, event string, dataLen int) (p []byte) {
-	// calc length
-	l := 6 // data\n\n
-	if len(event) > 0 {
-		l += 6 + len(event) + 1 // event:{event}\n
+// deliver sends data to cl without blocking, falling back to lagPolicy
+// when its queue is full.
+func (s *Streamer) deliver(cl client, info *clientInfo, data []byte) {
+	select {
+	case cl <- data:
+		info.consecutiveDrops = 0
+		return
+	default:
 	}
-	if dataLen > 0 {
-		l += 1 + dataLen // :{data}
+
+	info.consecutiveDrops++
+	s.dropped.Add(1)
+
+	switch s.lagPolicy {
+	case LagPolicyDisconnect:
+		if info.consecutiveDrops >= s.maxConsecutiveDrops {
+			select {
+			case <-cl: // make room for the lag notice
+			default:
+			}
+			select {
+			case cl <- lagEvent:
+			default:
+			}
+			s.lagged.Add(1)
+			s.removeClient(cl, "lag")
+		}
+
+	default: // LagPolicyDropOldest
+		select {
+		case <-cl: // drop the oldest queued event
+		default:
+		}
+		select {
+		case cl <- data:
+		default:
+		}
 	}
+}
 
-	// build
-	p = make([]byte, l)
-	i := 0
+// removeClient unsubscribes cl from every topic, closes its channel so
+// ServeHTTP's read loop returns, and reports reason via OnDisconnect.
+func (s *Streamer) removeClient(cl client, reason string) {
+	info, ok := s.clients[cl]
+	if !ok {
+		return
+	}
+	for t := range info.topics {
+		delete(s.byTopic[t], cl)
+		if len(s.byTopic[t]) == 0 {
+			delete(s.byTopic, t)
+		}
+	}
+	delete(s.clients, cl)
+	s.connected.Add(-1)
+	close(cl)
+
+	if s.onDisconnect != nil {
+		s.onDisconnect(reason)
+	}
+}
+
+// nextID returns id, or an auto-generated monotonic id if id is empty
+// and replay is enabled, so every replayable event can be addressed by
+// Last-Event-ID even if the caller doesn't track ids itself.
+func (s *Streamer) nextID(id string) string {
+	if id == "" && s.replay != nil {
+		return s.replay.nextID()
+	}
+	return id
+}
+
+// SetRetry sets the reconnection delay advertised to clients: every new
+// connection is sent a retry:N line up front, and the very next broadcast
+// also carries one, so already-connected clients pick up the change too.
+func (s *Streamer) SetRetry(d time.Duration) {
+	s.retryMillis.Store(d.Milliseconds())
+	s.retryPending.Store(true)
+}
+
+// takeRetry returns the retry value to embed in the next formatted event,
+// or 0 if none is due. It's consumed at most once per SetRetry call.
+func (s *Streamer) takeRetry() int64 {
+	if !s.retryPending.CompareAndSwap(true, false) {
+		return 0
+	}
+	return s.retryMillis.Load()
+}
+
+// Heartbeat enables a ": keepalive\n\n" comment line on every connection
+// every interval, to stop intermediate proxies from closing idle streams.
+// A zero interval (the default) disables heartbeats.
+func (s *Streamer) Heartbeat(interval time.Duration) {
+	s.heartbeatNanos.Store(int64(interval))
+}
+
+// format serializes one SSE event: an optional event: line, an optional
+// id: line, an optional retry: line (retryMillis <= 0 omits it), and one
+// data: line per "\n"-separated segment of data (a trailing "\r" on any
+// segment is stripped, per the EventSource parsing algorithm).
+func format(id, event string, retryMillis int64, data []byte) []byte {
+	var p []byte
 	if len(event) > 0 {
-		copy(p, "event:")
-		i += 6 + copy(p[6:], event)
-		p[i] = '\n'
-		i++
+		p = append(p, "event:"...)
+		p = append(p, event...)
+		p = append(p, '\n')
+	}
+	if len(id) > 0 {
+		p = append(p, "id:"...)
+		p = append(p, id...)
+		p = append(p, '\n')
 	}
-	i += copy(p[i:], "data")
-	if dataLen > 0 {
-		p[i] = ':'
-		i += 1 + dataLen
+	if retryMillis > 0 {
+		p = append(p, "retry:"...)
+		p = strconv.AppendInt(p, retryMillis, 10)
+		p = append(p, '\n')
+	}
+
+	if len(data) == 0 {
+		p = append(p, "data\n"...)
+	} else {
+		start := 0
+		for i, b := range data {
+			if b != '\n' {
+				continue
+			}
+			p = append(p, "data:"...)
+			p = append(p, trimCR(data[start:i])...)
+			p = append(p, '\n')
+			start = i + 1
+		}
+		p = append(p, "data:"...)
+		p = append(p, trimCR(data[start:])...)
+		p = append(p, '\n')
 	}
-	copy(p[i:], "\n\n")
 
-	// TODO: id
+	p = append(p, '\n')
+	return p
+}
 
-	return
+// trimCR strips a trailing "\r" so CRLF-terminated data doesn't leak a
+// stray carriage return into the data: line.
+func trimCR(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		return line[:n-1]
+	}
+	return line
 }
 
 // SendBytes sends an event with the given byte slice interpreted as a string
 // as the data value to all connected clients.
 // If the id or event string is empty, no id / event type is send.
-func (s *Streamer) SendBytes(id, event string, data []byte) {
-	p := format(id, event, len(data))
-	copy(p[len(p)-(2+len(data)):], data) // fill in data
-	s.event <- p
+func (s *Streamer) SendBytes(id, ev string, data []byte) {
+	s.SendBytesTo(defaultTopic, id, ev, data)
+}
+
+// SendBytesTo is like SendBytes, but only delivers to clients subscribed
+// to topic.
+func (s *Streamer) SendBytesTo(topic, id, ev string, data []byte) {
+	id = s.nextID(id)
+	p := format(id, ev, s.takeRetry(), data)
+	s.event <- event{id: id, topic: topic, data: p}
 }
 
 // SendInt sends an event with the given int as the data value to all connected
 // clients.
 // If the id or event string is empty, no id / event type is send.
-func (s *Streamer) SendInt(id, event string, data int64) {
-	const maxIntToStrLen = 20 // '-' + 19 digits
-
-	p := format(id, event, maxIntToStrLen)
-	p = strconv.AppendInt(p[:len(p)-(maxIntToStrLen+2)], data, 10)
-
-	// Re-add \n\n at the end
-	p = p[:len(p)+2]
-	p[len(p)-2] = '\n'
-	p[len(p)-1] = '\n'
+func (s *Streamer) SendInt(id, ev string, data int64) {
+	s.SendIntTo(defaultTopic, id, ev, data)
+}
 
-	s.event <- p
+// SendIntTo is like SendInt, but only delivers to clients subscribed to
+// topic.
+func (s *Streamer) SendIntTo(topic, id, ev string, data int64) {
+	var buf [20]byte // '-' + 19 digits
+	id = s.nextID(id)
+	p := format(id, ev, s.takeRetry(), strconv.AppendInt(buf[:0], data, 10))
+	s.event <- event{id: id, topic: topic, data: p}
 }
 
 // SendJSON sends an event with the given data encoded as JSON to all connected
 // clients.
 // If the id or event string is empty, no id / event type is send.
 func (s *Streamer) SendJSON(id, event string, v interface{}) error {
+	return s.SendJSONTo(defaultTopic, id, event, v)
+}
+
+// SendJSONTo is like SendJSON, but only delivers to clients subscribed to
+// topic.
+func (s *Streamer) SendJSONTo(topic, id, event string, v interface{}) error {
 	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	s.SendBytes(id, event, data)
+	s.SendBytesTo(topic, id, event, data)
 	return nil
 }
 
 // SendString sends an event with the given data string to all connected
 // clients.
 // If the id or event string is empty, no id / event type is send.
-func (s *Streamer) SendString(id, event, data string) {
-	p := format(id, event, len(data))
-	copy(p[len(p)-(2+len(data)):], data) // fill in data
-	s.event <- p
+func (s *Streamer) SendString(id, ev, data string) {
+	s.SendStringTo(defaultTopic, id, ev, data)
+}
+
+// SendStringTo is like SendString, but only delivers to clients subscribed
+// to topic.
+func (s *Streamer) SendStringTo(topic, id, ev, data string) {
+	id = s.nextID(id)
+	p := format(id, ev, s.takeRetry(), []byte(data))
+	s.event <- event{id: id, topic: topic, data: p}
 }
 
 // SendUint sends an event with the given unsigned int as the data value to all
 // connected clients.
 // If the id or event string is empty, no id / event type is send.
-func (s *Streamer) SendUint(id, event string, data uint64) {
-	const maxUintToStrLen = 20
-
-	p := format(id, event, maxUintToStrLen)
-	p = strconv.AppendUint(p[:len(p)-(maxUintToStrLen+2)], data, 10)
-
-	// Re-add \n\n at the end
-	p = p[:len(p)+2]
-	p[len(p)-2] = '\n'
-	p[len(p)-1] = '\n'
+func (s *Streamer) SendUint(id, ev string, data uint64) {
+	s.SendUintTo(defaultTopic, id, ev, data)
+}
 
-	s.event <- p
+// SendUintTo is like SendUint, but only delivers to clients subscribed to
+// topic.
+func (s *Streamer) SendUintTo(topic, id, ev string, data uint64) {
+	var buf [20]byte
+	id = s.nextID(id)
+	p := format(id, ev, s.takeRetry(), strconv.AppendUint(buf[:0], data, 10))
+	s.event <- event{id: id, topic: topic, data: p}
 }
 
 // ServeHTTP implements http.Handler interface.
-func (s *Streamer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+func (s *Streamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// We need to be able to flush for SSE
 	fl, ok := w.(http.Flusher)
 	if !ok {
@@ -160,33 +479,97 @@ func (s *Streamer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 
-	// Returns a channel that blocks until the connection is closed
-	cn, ok := w.(http.CloseNotifier)
-	if !ok {
-		http.Error(w, "Closing not supported", http.StatusNotImplemented)
-		return
-	}
-	close := cn.CloseNotify()
-
 	// Set headers for SSE
 	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Content-Type", "text/event-stream")
+	if r.ProtoMajor < 2 {
+		// Connection is hop-by-hop and invalid over HTTP/2 and later,
+		// where a single connection multiplexes many concurrent streams.
+		w.Header().Set("Connection", "keep-alive")
+	}
+
+	// Pre-push critical assets (e.g. an EventSource polyfill) alongside
+	// the stream itself, if the server and protocol support it.
+	if pusher, ok := w.(http.Pusher); ok {
+		for _, target := range s.PushResources {
+			pusher.Push(target, nil) // best effort, errors are non-fatal
+		}
+	}
+
+	// Determine the topics this client subscribes to, beyond the default
+	// broadcast topic: TopicsFunc takes precedence over the `topic` query
+	// parameter(s).
+	var topics []string
+	if s.TopicsFunc != nil {
+		topics = s.TopicsFunc(r)
+	} else {
+		topics = r.URL.Query()["topic"]
+	}
+	subscribed := make(map[string]struct{}, len(topics)+1)
+	subscribed[defaultTopic] = struct{}{}
+	for _, t := range topics {
+		subscribed[t] = struct{}{}
+	}
+
+	// Replay anything the client missed while disconnected, identified by
+	// the Last-Event-ID header or, for EventSource polyfills that can't
+	// set headers, the lastEventId query parameter. Only entries whose
+	// topic this client is subscribed to are replayed, so a client never
+	// receives an event it was never meant to see.
+	if s.replay != nil {
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("lastEventId")
+		}
+		if lastID != "" {
+			for _, p := range s.replay.since(lastID, subscribed) {
+				w.Write(p)
+			}
+			fl.Flush()
+		}
+	}
+
+	// Let a newly connecting client know the current reconnection delay
+	// right away, even if it doesn't coincide with a broadcast.
+	if ms := s.retryMillis.Load(); ms > 0 {
+		w.Write(format("", "", ms, nil))
+		fl.Flush()
+	}
 
 	// Connect new client
-	cl := make(client)
-	s.connecting <- cl
+	cl := make(client, s.clientQueue)
+	s.connecting <- subscriber{cl: cl, topics: topics}
+
+	// Periodically send a comment line so intermediate proxies don't
+	// close the connection for being idle.
+	var heartbeatC <-chan time.Time
+	if d := time.Duration(s.heartbeatNanos.Load()); d > 0 {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		heartbeatC = ticker.C
+	}
+
+	ctx := r.Context()
 
 	for {
 		select {
-		case <-close:
+		case <-ctx.Done():
 			// Disconnect the client when the connection is closed
 			s.disconnecting <- cl
 			return
 
-		case event := <-cl:
+		case msg, ok := <-cl:
+			if !ok {
+				// The broadcaster closed our channel, e.g. after
+				// evicting us for lagging too far behind.
+				return
+			}
 			// Write events
-			w.Write(event) // TODO: error handling
+			w.Write(msg) // TODO: error handling
+			fl.Flush()
+
+		case <-heartbeatC:
+			w.Write([]byte(": keepalive\n\n"))
 			fl.Flush()
 		}
 	}
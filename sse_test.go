@@ -0,0 +1,660 @@
+// Copyright 2015 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by MIT license,
+// a copy can be found in the LICENSE file.
+
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scanLines runs a real bufio.Scanner over p, the way a browser's
+// EventSource would, and returns every line (without the terminator).
+func scanLines(t *testing.T, p []byte) []string {
+	t.Helper()
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(p))
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// fakeResponseWriter is a minimal http.ResponseWriter that also implements
+// http.Flusher, so ServeHTTP can be driven directly without a real network
+// connection. Disconnects are simulated by cancelling the request's context,
+// the same signal ServeHTTP watches in production.
+type fakeResponseWriter struct {
+	header http.Header
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newFakeResponseWriter() *fakeResponseWriter {
+	return &fakeResponseWriter{header: make(http.Header)}
+}
+
+func (w *fakeResponseWriter) Header() http.Header { return w.header }
+
+func (w *fakeResponseWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *fakeResponseWriter) WriteHeader(int) {}
+
+func (w *fakeResponseWriter) Flush() {}
+
+func (w *fakeResponseWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// fakePusher adds http.Pusher to a fakeResponseWriter, recording every
+// pushed target.
+type fakePusher struct {
+	*fakeResponseWriter
+
+	mu     sync.Mutex
+	pushed []string
+}
+
+func newFakePusher() *fakePusher {
+	return &fakePusher{fakeResponseWriter: newFakeResponseWriter()}
+}
+
+func (w *fakePusher) Push(target string, opts *http.PushOptions) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+func (w *fakePusher) Targets() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.pushed...)
+}
+
+// serve drives ServeHTTP in the background and returns the response writer
+// plus a func that disconnects the client and waits for ServeHTTP to return.
+func serve(s *Streamer, req *http.Request) (w *fakeResponseWriter, disconnect func()) {
+	w = newFakeResponseWriter()
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.ServeHTTP(w, req)
+		close(done)
+	}()
+	return w, func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestReplayKnownLastEventID(t *testing.T) {
+	s := NewWithReplay(10)
+	s.SendString("1", "", "a")
+	s.SendString("2", "", "b")
+	s.SendString("3", "", "c")
+	time.Sleep(10 * time.Millisecond) // let the broadcaster catch up
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Last-Event-ID", "2")
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond) // let the replay write happen
+	disconnect()
+
+	got := w.String()
+	want := "id:3\ndata:c\n\n"
+	if got != want {
+		t.Errorf("replay after known id = %q, want %q", got, want)
+	}
+}
+
+func TestReplayUnknownLastEventID(t *testing.T) {
+	s := NewWithReplay(10)
+	s.SendString("1", "", "a")
+	s.SendString("2", "", "b")
+	time.Sleep(10 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Last-Event-ID", "unknown")
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond)
+	disconnect()
+
+	got := w.String()
+	want := "id:1\ndata:a\n\nid:2\ndata:b\n\n"
+	if got != want {
+		t.Errorf("replay after unknown id = %q, want %q (best-effort full replay)", got, want)
+	}
+}
+
+func TestReplayEmptyLastEventID(t *testing.T) {
+	s := NewWithReplay(10)
+	s.SendString("1", "", "a")
+	time.Sleep(10 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond)
+
+	s.SendString("2", "", "b")
+	time.Sleep(10 * time.Millisecond)
+	disconnect()
+
+	got := w.String()
+	want := "id:2\ndata:b\n\n"
+	if got != want {
+		t.Errorf("with no Last-Event-ID, got %q, want only the new event %q", got, want)
+	}
+}
+
+func TestReplayQueryParamFallback(t *testing.T) {
+	s := NewWithReplay(10)
+	s.SendString("1", "", "a")
+	s.SendString("2", "", "b")
+	time.Sleep(10 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/?lastEventId=1", nil)
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond)
+	disconnect()
+
+	got := w.String()
+	want := "id:2\ndata:b\n\n"
+	if got != want {
+		t.Errorf("replay via lastEventId query param = %q, want %q", got, want)
+	}
+}
+
+func TestReplayDoesNotLeakAcrossTopics(t *testing.T) {
+	s := NewWithOptions(StreamerOptions{ReplayCapacity: 10})
+	s.SendStringTo("a", "1", "", "for-a")
+	s.SendStringTo("b", "1", "secret", "top-secret-for-b-only")
+	time.Sleep(10 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/?topic=a", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond)
+	disconnect()
+
+	got := w.String()
+	if strings.Contains(got, "top-secret-for-b-only") {
+		t.Fatalf("topic-a subscriber received topic-b replay: %q", got)
+	}
+	want := "id:1\ndata:for-a\n\n"
+	if got != want {
+		t.Errorf("replay for topic a = %q, want %q", got, want)
+	}
+}
+
+func TestReplayBufferOverflowEvictsOldest(t *testing.T) {
+	b := newReplayBuffer(2)
+	allTopics := map[string]struct{}{"": {}}
+	b.push("1", "", []byte("a"))
+	b.push("2", "", []byte("b"))
+	b.push("3", "", []byte("c")) // evicts "1"
+
+	got := b.since("", allTopics)
+	if len(got) != 2 {
+		t.Fatalf("since(\"\") = %d entries, want 2 (best-effort, full buffer)", len(got))
+	}
+
+	got = b.since("2", allTopics)
+	if len(got) != 1 || string(got[0]) != "c" {
+		t.Fatalf("since(\"2\") = %v, want [c]", got)
+	}
+
+	got = b.since("1", allTopics) // evicted, so treated as unknown
+	if len(got) != 2 {
+		t.Fatalf("since(\"1\") after eviction = %d entries, want 2 (full buffer)", len(got))
+	}
+}
+
+func TestSendAutoAssignsIDWhenReplayEnabled(t *testing.T) {
+	s := NewWithReplay(4)
+	s.SendString("", "", "a")
+	s.SendString("", "", "b")
+	time.Sleep(10 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond)
+	disconnect()
+
+	got := w.String()
+	want := "id:2\ndata:b\n\n"
+	if got != want {
+		t.Errorf("replay after auto-assigned id = %q, want %q", got, want)
+	}
+}
+
+func TestSendBytesToOnlyReachesSubscribedClients(t *testing.T) {
+	s := New()
+
+	subA, disconnectA := serve(s, httptest.NewRequest(http.MethodGet, "/?topic=a", nil))
+	subB, disconnectB := serve(s, httptest.NewRequest(http.MethodGet, "/?topic=b", nil))
+	time.Sleep(10 * time.Millisecond) // let both clients register
+
+	s.SendStringTo("a", "", "", "only-a")
+	time.Sleep(10 * time.Millisecond)
+	disconnectA()
+	disconnectB()
+
+	if got, want := subA.String(), "data:only-a\n\n"; got != want {
+		t.Errorf("subscriber of topic a got %q, want %q", got, want)
+	}
+	if got := subB.String(); got != "" {
+		t.Errorf("subscriber of topic b got %q, want nothing", got)
+	}
+}
+
+func TestSendBytesReachesAllTopics(t *testing.T) {
+	s := New()
+
+	subA, disconnectA := serve(s, httptest.NewRequest(http.MethodGet, "/?topic=a", nil))
+	subNone, disconnectNone := serve(s, httptest.NewRequest(http.MethodGet, "/", nil))
+	time.Sleep(10 * time.Millisecond)
+
+	s.SendString("", "", "everyone")
+	time.Sleep(10 * time.Millisecond)
+	disconnectA()
+	disconnectNone()
+
+	want := "data:everyone\n\n"
+	if got := subA.String(); got != want {
+		t.Errorf("topic-a subscriber got %q, want %q", got, want)
+	}
+	if got := subNone.String(); got != want {
+		t.Errorf("untargeted subscriber got %q, want %q", got, want)
+	}
+}
+
+func TestTopicsFuncTakesPrecedenceOverQuery(t *testing.T) {
+	s := New()
+	s.TopicsFunc = func(r *http.Request) []string { return []string{"override"} }
+
+	sub, disconnect := serve(s, httptest.NewRequest(http.MethodGet, "/?topic=ignored", nil))
+	time.Sleep(10 * time.Millisecond)
+
+	s.SendStringTo("override", "", "", "hit")
+	time.Sleep(10 * time.Millisecond)
+	disconnect()
+
+	if got, want := sub.String(), "data:hit\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLagPolicyDropOldestEvictsOldestQueuedEvent(t *testing.T) {
+	s := NewWithOptions(StreamerOptions{ClientQueue: 2, LagPolicy: LagPolicyDropOldest})
+
+	cl := make(client, 2)
+	s.connecting <- subscriber{cl: cl}
+	time.Sleep(10 * time.Millisecond)
+
+	s.SendString("", "", "1")
+	s.SendString("", "", "2")
+	s.SendString("", "", "3") // queue full at 2; drops "1" to make room
+	time.Sleep(10 * time.Millisecond)
+
+	want := []string{"data:2\n\n", "data:3\n\n"}
+	for i, w := range want {
+		select {
+		case p := <-cl:
+			if string(p) != w {
+				t.Errorf("event %d = %q, want %q", i, p, w)
+			}
+		default:
+			t.Fatalf("expected %d buffered events, got %d", len(want), i)
+		}
+	}
+
+	if got := s.Stats().Dropped; got != 1 {
+		t.Errorf("Stats().Dropped = %d, want 1", got)
+	}
+}
+
+func TestLagPolicyDisconnectEvictsAfterThreshold(t *testing.T) {
+	var mu sync.Mutex
+	var reason string
+
+	s := NewWithOptions(StreamerOptions{
+		ClientQueue:         1,
+		LagPolicy:           LagPolicyDisconnect,
+		MaxConsecutiveDrops: 2,
+		OnDisconnect: func(r string) {
+			mu.Lock()
+			reason = r
+			mu.Unlock()
+		},
+	})
+
+	cl := make(client, 1)
+	s.connecting <- subscriber{cl: cl}
+	time.Sleep(10 * time.Millisecond)
+
+	s.SendString("", "", "1") // fills the queue
+	s.SendString("", "", "2") // drop 1/2
+	s.SendString("", "", "3") // drop 2/2 -> evict
+	time.Sleep(10 * time.Millisecond)
+
+	first, ok := <-cl
+	if !ok {
+		t.Fatal("expected the synthetic lag event before the channel closed")
+	}
+	if string(first) != string(lagEvent) {
+		t.Errorf("first queued event = %q, want the lag notice %q", first, lagEvent)
+	}
+	if _, ok := <-cl; ok {
+		t.Error("expected the channel to be closed after the lag notice")
+	}
+
+	mu.Lock()
+	gotReason := reason
+	mu.Unlock()
+	if gotReason != "lag" {
+		t.Errorf("OnDisconnect reason = %q, want %q", gotReason, "lag")
+	}
+
+	stats := s.Stats()
+	if stats.Dropped != 2 {
+		t.Errorf("Stats().Dropped = %d, want 2", stats.Dropped)
+	}
+	if stats.Lagged != 1 {
+		t.Errorf("Stats().Lagged = %d, want 1", stats.Lagged)
+	}
+	if stats.Connected != 0 {
+		t.Errorf("Stats().Connected = %d, want 0", stats.Connected)
+	}
+}
+
+// BenchmarkBroadcastWithSlowReader proves that one client which never
+// drains its queue doesn't block delivery to the other, fast readers.
+func BenchmarkBroadcastWithSlowReader(b *testing.B) {
+	s := NewWithOptions(StreamerOptions{ClientQueue: 16, LagPolicy: LagPolicyDropOldest})
+
+	const nFast = 50
+	for i := 0; i < nFast; i++ {
+		cl := make(client, 16)
+		s.connecting <- subscriber{cl: cl}
+		go func() {
+			for range cl {
+				// fast reader: drain as soon as events arrive
+			}
+		}()
+	}
+
+	slow := make(client, 16)
+	s.connecting <- subscriber{cl: slow} // never drained
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.SendString("", "", "x")
+	}
+}
+
+func TestFormatMultiLineData(t *testing.T) {
+	p := format("", "", 0, []byte("line one\nline two\r\nline three"))
+
+	lines := scanLines(t, p)
+	want := []string{"data:line one", "data:line two", "data:line three", ""}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines %q, want %d lines %q", len(lines), lines, len(want), want)
+	}
+	for i, w := range want {
+		if lines[i] != w {
+			t.Errorf("line %d = %q, want %q", i, lines[i], w)
+		}
+	}
+}
+
+func TestFormatRetry(t *testing.T) {
+	p := format("", "", 2500, []byte("hi"))
+
+	lines := scanLines(t, p)
+	want := []string{"retry:2500", "data:hi", ""}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines %q, want %d lines %q", len(lines), lines, len(want), want)
+	}
+	for i, w := range want {
+		if lines[i] != w {
+			t.Errorf("line %d = %q, want %q", i, lines[i], w)
+		}
+	}
+}
+
+func TestSetRetrySendsOnceThenStops(t *testing.T) {
+	s := New()
+	s.SetRetry(2 * time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond) // let the retry preamble land
+
+	s.SendString("", "", "a") // carries retry: once
+	s.SendString("", "", "b") // no retry: anymore
+	time.Sleep(10 * time.Millisecond)
+	disconnect()
+
+	got := w.String()
+	want := "retry:2000\ndata\n\n" + "retry:2000\ndata:a\n\n" + "data:b\n\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHeartbeatSendsKeepaliveComment(t *testing.T) {
+	s := New()
+	s.Heartbeat(10 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w, disconnect := serve(s, req)
+	time.Sleep(35 * time.Millisecond) // long enough for a couple of ticks
+	disconnect()
+
+	got := w.String()
+	if n := strings.Count(got, ": keepalive\n\n"); n < 2 {
+		t.Errorf("got %d keepalive comments in %q, want at least 2", n, got)
+	}
+}
+
+// TestServeHTTPDisconnectsOnContextCancel simulates an http.Server under
+// plain net/http: the request context is cancelled (as it is when the
+// client's TCP connection closes), and ServeHTTP must return without
+// relying on http.CloseNotifier.
+func TestServeHTTPDisconnectsOnContextCancel(t *testing.T) {
+	s := New()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond)
+	if got := s.Stats().Connected; got != 1 {
+		t.Fatalf("Connected = %d, want 1", got)
+	}
+
+	disconnect()                      // cancels the request context, like a closed connection would
+	time.Sleep(10 * time.Millisecond) // let the broadcaster process the disconnect
+
+	if got := s.Stats().Connected; got != 0 {
+		t.Errorf("Connected after disconnect = %d, want 0", got)
+	}
+	_ = w
+}
+
+// TestServeHTTPKeepAliveHeaderHTTP1 verifies the Connection: keep-alive
+// header is still sent under HTTP/1.1, where it's meaningful.
+func TestServeHTTPKeepAliveHeaderHTTP1(t *testing.T) {
+	s := New()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.ProtoMajor = 1
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond)
+	disconnect()
+
+	if got := w.Header().Get("Connection"); got != "keep-alive" {
+		t.Errorf("Connection header = %q, want %q", got, "keep-alive")
+	}
+}
+
+// TestServeHTTPSkipsKeepAliveHeaderOverHTTP2 verifies the hop-by-hop
+// Connection header, invalid over HTTP/2, is omitted when the request
+// arrives over an HTTP/2 connection (net/http2 sets ProtoMajor to 2).
+func TestServeHTTPSkipsKeepAliveHeaderOverHTTP2(t *testing.T) {
+	s := New()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.ProtoMajor = 2
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond)
+	disconnect()
+
+	if got := w.Header().Get("Connection"); got != "" {
+		t.Errorf("Connection header = %q, want empty under HTTP/2", got)
+	}
+}
+
+// TestServeHTTPPushesResourcesOverHTTP2 verifies PushResources are pushed
+// via http.Pusher, as offered by an HTTP/2 ResponseWriter.
+func TestServeHTTPPushesResourcesOverHTTP2(t *testing.T) {
+	s := New()
+	s.PushResources = []string{"/static/polyfill.js", "/static/app.css"}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.ProtoMajor = 2
+	pw := newFakePusher()
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.ServeHTTP(pw, req)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+
+	got := pw.Targets()
+	want := []string{"/static/polyfill.js", "/static/app.css"}
+	if len(got) != len(want) {
+		t.Fatalf("pushed %v, want %v", got, want)
+	}
+	for i, w := range want {
+		if got[i] != w {
+			t.Errorf("pushed[%d] = %q, want %q", i, got[i], w)
+		}
+	}
+}
+
+// TestServeHTTPNoPushOverHTTP1 verifies no Push calls are attempted when
+// the ResponseWriter doesn't implement http.Pusher, as under plain HTTP/1.
+func TestServeHTTPNoPushOverHTTP1(t *testing.T) {
+	s := New()
+	s.PushResources = []string{"/static/polyfill.js"}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w, disconnect := serve(s, req)
+	time.Sleep(10 * time.Millisecond)
+	disconnect() // must not panic: w isn't an http.Pusher
+
+	if w.String() != "" {
+		t.Errorf("got %q, want no output", w.String())
+	}
+}
+
+// streamFirstEvent issues a GET against url and returns the response along
+// with a disconnect func that closes the client side of the connection;
+// callers must call disconnect before shutting down the server, so
+// ServeHTTP's handler goroutine isn't left streaming to a connection the
+// server is waiting to drain.
+func streamFirstEvent(t *testing.T, client *http.Client, url string) (resp *http.Response, disconnect func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	return resp, func() {
+		resp.Body.Close()
+		cancel()
+	}
+}
+
+// TestServeHTTPOverRealHTTP1Server drives the Streamer behind a genuine
+// net/http server speaking HTTP/1.1, rather than the in-memory
+// fakeResponseWriter used above, to confirm the keep-alive header survives
+// a real transport round trip.
+func TestServeHTTPOverRealHTTP1Server(t *testing.T) {
+	s := New()
+	s.SetRetry(10 * time.Millisecond) // flushes headers immediately on connect
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, disconnect := streamFirstEvent(t, srv.Client(), srv.URL)
+	defer disconnect()
+
+	if resp.ProtoMajor != 1 {
+		t.Fatalf("ProtoMajor = %d, want 1", resp.ProtoMajor)
+	}
+	if got := resp.Header.Get("Connection"); got != "keep-alive" {
+		t.Errorf("Connection header = %q, want %q", got, "keep-alive")
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type header = %q, want %q", got, "text/event-stream")
+	}
+}
+
+// TestServeHTTPOverRealHTTP2Server drives the Streamer behind a genuine
+// net/http2 server (httptest's stdlib-only HTTP/2 support), confirming the
+// Connection header is omitted over an actual HTTP/2 connection rather than
+// a request with ProtoMajor hand-set to 2. PushResources is set so the push
+// path runs, but no pushed stream is checked here.
+func TestServeHTTPOverRealHTTP2Server(t *testing.T) {
+	s := New()
+	s.PushResources = []string{"/static/polyfill.js"}
+	s.SetRetry(10 * time.Millisecond) // flushes headers immediately on connect
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, disconnect := streamFirstEvent(t, srv.Client(), srv.URL)
+	defer disconnect()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("ProtoMajor = %d, want 2 (real HTTP/2 round trip)", resp.ProtoMajor)
+	}
+	if got := resp.Header.Get("Connection"); got != "" {
+		t.Errorf("Connection header = %q, want empty under real HTTP/2", got)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type header = %q, want %q", got, "text/event-stream")
+	}
+}